@@ -1,6 +1,10 @@
 package main
 
 import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,6 +13,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,26 +25,138 @@ import (
 )
 
 type NginxStats struct {
-	Connections struct {
-		Accepted int `json:"accepted"`
-		Dropped  int `json:"dropped"`
-		Active   int `json:"active"`
-		Idle     int `json:"idle"`
-	} `json:"connections"`
-	SSLs struct {
-		Handshakes       int64 `json:"handshakes"`
-		HandshakesFailed int64 `json:"handshakes_failed"`
-		SessionReuses    int64 `json:"session_reuses"`
-	} `json:"ssl"`
-	Requests struct {
-		Total   int64 `json:"total"`
-		Current int   `json:"current"`
-	} `json:"requests"`
+	Connections ConnectionsStats `json:"connections"`
+	SSLs        SSLStats         `json:"ssl"`
+	Requests    RequestsStats    `json:"requests"`
 
 	ServerZones   map[string]Server   `json:"server_zones"`
 	UpstreamZones map[string]Upstream `json:"upstreams"`
 }
 
+// ConnectionsStats, SSLStats and RequestsStats mirror both the legacy stub
+// status payload and the equivalent /connections, /ssl and /http/requests
+// resources of the NGINX Plus API, so the same types decode either one.
+type ConnectionsStats struct {
+	Accepted int `json:"accepted"`
+	Dropped  int `json:"dropped"`
+	Active   int `json:"active"`
+	Idle     int `json:"idle"`
+}
+
+type SSLStats struct {
+	Handshakes       int64 `json:"handshakes"`
+	HandshakesFailed int64 `json:"handshakes_failed"`
+	SessionReuses    int64 `json:"session_reuses"`
+}
+
+type RequestsStats struct {
+	Total   int64 `json:"total"`
+	Current int   `json:"current"`
+}
+
+// StreamServerZone is the /stream/server_zones resource of the NGINX Plus API.
+type StreamServerZone struct {
+	Connections int64 `json:"connections"`
+	Received    int64 `json:"received"`
+	Sent        int64 `json:"sent"`
+}
+
+// StreamUpstream is the /stream/upstreams resource of the NGINX Plus API.
+type StreamUpstream struct {
+	Peers []struct {
+		Server       string `json:"server"`
+		Backup       bool   `json:"backup"`
+		Weight       int    `json:"weight"`
+		State        string `json:"state"`
+		Active       int    `json:"active"`
+		MaxConns     int    `json:"max_conns"`
+		Connections  int64  `json:"connections"`
+		Sent         int64  `json:"sent"`
+		Received     int64  `json:"received"`
+		Fails        int64  `json:"fails"`
+		Unavail      int64  `json:"unavail"`
+		HealthChecks struct {
+			Checks     int64 `json:"checks"`
+			Fails      int64 `json:"fails"`
+			Unhealthy  int64 `json:"unhealthy"`
+			LastPassed *bool `json:"last_passed"`
+		} `json:"health_checks"`
+		Downtime  int64 `json:"downtime"`
+		Downstart int64 `json:"downstart"`
+		Selected  int64 `json:"selected"`
+	} `json:"peers"`
+	Zombies int `json:"zombies"`
+}
+
+// LocationZone is the /http/location_zones resource of the NGINX Plus API.
+type LocationZone struct {
+	Requests  int64 `json:"requests"`
+	Responses struct {
+		Responses1xx int64 `json:"1xx"`
+		Responses2xx int64 `json:"2xx"`
+		Responses3xx int64 `json:"3xx"`
+		Responses4xx int64 `json:"4xx"`
+		Responses5xx int64 `json:"5xx"`
+		Total        int64 `json:"total"`
+	} `json:"responses"`
+	Discarded int64 `json:"discarded"`
+	Received  int64 `json:"received"`
+	Sent      int64 `json:"sent"`
+}
+
+// Resolver is the /resolvers resource of the NGINX Plus API.
+type Resolver struct {
+	Requests struct {
+		Name int64 `json:"name"`
+		Srv  int64 `json:"srv"`
+		Addr int64 `json:"addr"`
+	} `json:"requests"`
+	Responses struct {
+		NoError  int64 `json:"noerror"`
+		Formerr  int64 `json:"formerr"`
+		Servfail int64 `json:"servfail"`
+		Nxdomain int64 `json:"nxdomain"`
+		Notimp   int64 `json:"notimp"`
+		Refused  int64 `json:"refused"`
+		Timedout int64 `json:"timedout"`
+		Unknown  int64 `json:"unknown"`
+	} `json:"responses"`
+}
+
+// CacheStats is a single hit/miss/bypass/... counter pair of the /http/caches resource.
+type CacheStats struct {
+	Responses int64 `json:"responses"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Cache is the /http/caches resource of the NGINX Plus API.
+type Cache struct {
+	Size        int64      `json:"size"`
+	MaxSize     int64      `json:"max_size"`
+	Cold        bool       `json:"cold"`
+	Hit         CacheStats `json:"hit"`
+	Stale       CacheStats `json:"stale"`
+	Updating    CacheStats `json:"updating"`
+	Revalidated CacheStats `json:"revalidated"`
+	Miss        CacheStats `json:"miss"`
+	Expired     CacheStats `json:"expired"`
+	Bypass      CacheStats `json:"bypass"`
+}
+
+// Slab is the /slabs resource of the NGINX Plus API.
+type Slab struct {
+	Pages struct {
+		Used int64 `json:"used"`
+		Free int64 `json:"free"`
+	} `json:"pages"`
+	Slots map[string]struct {
+		Used  int64 `json:"used"`
+		Free  int64 `json:"free"`
+		Reqs  int64 `json:"reqs"`
+		Fails int64 `json:"fails"`
+	} `json:"slots"`
+}
+
 type Server struct {
 	Processing int   `json:"processing"`
 	Requests   int64 `json:"requests"`
@@ -100,52 +220,302 @@ type Upstream struct {
 type Exporter struct {
 	URI string
 
+	client      *http.Client
+	bearerToken string
+
 	connectionsMetrics, sslMetrics, requestsMetrics, serverMetrics, upstreamMetrics map[string]*prometheus.Desc
+
+	streamServerMetrics, streamUpstreamMetrics, locationZoneMetrics, resolverMetrics, cacheMetrics, slabMetrics map[string]*prometheus.Desc
+
+	up                 *prometheus.Desc
+	totalScrapesDesc   *prometheus.Desc
+	scrapeFailuresDesc *prometheus.Desc
+	stats              *scrapeStats
+
+	// metricDescs records the metricDump (name, help, type, labels) each
+	// *prometheus.Desc owned by this Exporter was built with, keyed by the
+	// Desc pointer itself. -dump-metrics consults this to report each
+	// metric's inventory entry without having to recover it from Desc,
+	// which offers no accessors and whose String() format is explicitly
+	// documented as unstable.
+	metricDescs map[*prometheus.Desc]metricDump
+}
+
+// scrapeStats holds cumulative scrape counters for one nginx target.
+// metricsHandler builds a fresh Exporter (and registry) for every ?target=
+// request, so without a store outside that per-request registry these
+// counters would read back as 0 or 1 on every scrape instead of
+// accumulating.
+type scrapeStats struct {
+	total    uint64
+	failures uint64
 }
 
-func newCustomMetric(metricGroupName string, metricName string, docString string, labels []string) *prometheus.Desc {
-	return prometheus.NewDesc(
-		prometheus.BuildFQName(*metricsNamespace, metricGroupName, metricName),
-		docString, labels, nil,
-	)
+// scrapeStatsEntry is the value held by each scrapeStatsLRU element, pairing
+// the target back up so it can be deleted from scrapeStatsIndex on eviction.
+type scrapeStatsEntry struct {
+	target string
+	stats  *scrapeStats
 }
 
-func NewExporter(uri string) *Exporter {
+var (
+	scrapeStatsMu    sync.Mutex
+	scrapeStatsLRU   = list.New()
+	scrapeStatsIndex = make(map[string]*list.Element)
+)
+
+// scrapeStatsFor returns the cumulative scrapeStats for target, creating it
+// on first use. The ?target= query parameter reaches here unvalidated, so
+// tracked targets are capped at -telemetry.max-targets, evicting the least
+// recently used one once the cap is exceeded; without this an attacker able
+// to reach /metrics could grow scrapeStatsIndex without bound by scraping a
+// stream of distinct, never-reused target values.
+func scrapeStatsFor(target string) *scrapeStats {
+	scrapeStatsMu.Lock()
+	defer scrapeStatsMu.Unlock()
+
+	if el, ok := scrapeStatsIndex[target]; ok {
+		scrapeStatsLRU.MoveToFront(el)
+		return el.Value.(*scrapeStatsEntry).stats
+	}
+
+	el := scrapeStatsLRU.PushFront(&scrapeStatsEntry{target: target, stats: &scrapeStats{}})
+	scrapeStatsIndex[target] = el
+
+	for *maxTrackedTargets > 0 && scrapeStatsLRU.Len() > *maxTrackedTargets {
+		oldest := scrapeStatsLRU.Back()
+		scrapeStatsLRU.Remove(oldest)
+		delete(scrapeStatsIndex, oldest.Value.(*scrapeStatsEntry).target)
+	}
+
+	return el.Value.(*scrapeStatsEntry).stats
+}
+
+// valueTypeName renders a prometheus.ValueType the way -dump-metrics reports
+// it in its "type" field.
+func valueTypeName(t prometheus.ValueType) string {
+	switch t {
+	case prometheus.CounterValue:
+		return "counter"
+	case prometheus.GaugeValue:
+		return "gauge"
+	default:
+		return "untyped"
+	}
+}
+
+func NewExporter(uri string) (*Exporter, error) {
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("building HTTP client: %v", err)
+	}
+
+	bearerToken, err := readBearerToken()
+	if err != nil {
+		return nil, fmt.Errorf("reading bearer token: %v", err)
+	}
+
+	// metricDescs is local to this Exporter, so concurrent NewExporter
+	// calls (e.g. concurrent ?target= scrapes) never write into shared
+	// state.
+	metricDescs := make(map[*prometheus.Desc]metricDump)
+	newCustomMetric := func(metricGroupName string, metricName string, docString string, labels []string, valueType prometheus.ValueType) *prometheus.Desc {
+		fqName := prometheus.BuildFQName(*metricsNamespace, metricGroupName, metricName)
+		desc := prometheus.NewDesc(fqName, docString, labels, constLabels)
+		metricDescs[desc] = metricDump{Name: fqName, Help: docString, Type: valueTypeName(valueType), Labels: labels}
+		return desc
+	}
+
+	totalScrapesName := prometheus.BuildFQName(*metricsNamespace, "exporter", "scrapes_total")
+	totalScrapesHelp := "Current total nginx scrapes."
+	totalScrapesDesc := prometheus.NewDesc(totalScrapesName, totalScrapesHelp, nil, constLabels)
+	metricDescs[totalScrapesDesc] = metricDump{Name: totalScrapesName, Help: totalScrapesHelp, Type: "counter"}
+
+	scrapeFailuresName := prometheus.BuildFQName(*metricsNamespace, "exporter", "scrape_failures_total")
+	scrapeFailuresHelp := "Number of errors while scraping nginx."
+	scrapeFailuresDesc := prometheus.NewDesc(scrapeFailuresName, scrapeFailuresHelp, nil, constLabels)
+	metricDescs[scrapeFailuresDesc] = metricDump{Name: scrapeFailuresName, Help: scrapeFailuresHelp, Type: "counter"}
 
 	return &Exporter{
-		URI: uri,
+		URI:         uri,
+		client:      client,
+		bearerToken: bearerToken,
 		connectionsMetrics: map[string]*prometheus.Desc{
-			"accepted": newCustomMetric("connections", "accepted", "nginx connections", nil),
-			"dropped":  newCustomMetric("connections", "dropped", "nginx connections", nil),
-			"active":   newCustomMetric("connections", "active", "nginx connections", nil),
-			"idle":     newCustomMetric("connections", "idle", "nginx connections", nil),
+			"accepted": newCustomMetric("connections", "accepted", "accepted client connections counter", nil, prometheus.CounterValue),
+			"dropped":  newCustomMetric("connections", "dropped", "dropped client connections counter", nil, prometheus.CounterValue),
+			"active":   newCustomMetric("connections", "active", "active client connections", nil, prometheus.GaugeValue),
+			"idle":     newCustomMetric("connections", "idle", "idle client connections", nil, prometheus.GaugeValue),
 		},
 		sslMetrics: map[string]*prometheus.Desc{
-			"handshakes":        newCustomMetric("ssl", "handshakes", "nginx connections", nil),
-			"handshakes_failed": newCustomMetric("ssl", "handshakes_failed", "nginx connections", nil),
-			"session_reuses":    newCustomMetric("ssl", "session_reuses", "nginx connections", nil),
+			"handshakes":        newCustomMetric("ssl", "handshakes", "successful SSL handshakes counter", nil, prometheus.CounterValue),
+			"handshakes_failed": newCustomMetric("ssl", "handshakes_failed", "failed SSL handshakes counter", nil, prometheus.CounterValue),
+			"session_reuses":    newCustomMetric("ssl", "session_reuses", "session reuses during SSL handshake counter", nil, prometheus.CounterValue),
 		},
 		requestsMetrics: map[string]*prometheus.Desc{
-			"total":   newCustomMetric("requests", "total", "nginx connections", nil),
-			"current": newCustomMetric("requests", "current", "nginx connections", nil),
+			"total":   newCustomMetric("requests", "total", "total client requests counter", nil, prometheus.CounterValue),
+			"current": newCustomMetric("requests", "current", "client requests currently being processed", nil, prometheus.GaugeValue),
 		},
 		serverMetrics: map[string]*prometheus.Desc{
-			"processing": newCustomMetric("server", "processing", "nginx connections", []string{"server"}),
-			"requests":   newCustomMetric("server", "requests", "nginx connections", []string{"server"}),
-			"discarded":  newCustomMetric("server", "discarded", "nginx connections", []string{"server"}),
-			"received":   newCustomMetric("server", "received", "nginx connections", []string{"server"}),
-			"sent":       newCustomMetric("server", "sent", "nginx connections", []string{"server"}),
-			"responses":  newCustomMetric("server", "responses", "responses counter", []string{"server", "code"}),
+			"processing": newCustomMetric("server", "processing", "requests currently being processed by the server zone", []string{"server"}, prometheus.GaugeValue),
+			"requests":   newCustomMetric("server", "requests", "requests counter", []string{"server"}, prometheus.CounterValue),
+			"discarded":  newCustomMetric("server", "discarded", "requests discarded counter", []string{"server"}, prometheus.CounterValue),
+			"received":   newCustomMetric("server", "received", "bytes received counter", []string{"server"}, prometheus.CounterValue),
+			"sent":       newCustomMetric("server", "sent", "bytes sent counter", []string{"server"}, prometheus.CounterValue),
+			"responses":  newCustomMetric("server", "responses", "responses counter", []string{"server", "code"}, prometheus.CounterValue),
 		},
 		upstreamMetrics: map[string]*prometheus.Desc{
-			"requests":  newCustomMetric("upstream", "requests", "requests counter", []string{"server", "upstream"}),
-			"fails":     newCustomMetric("upstream", "fails", "fails counter", []string{"server", "upstream"}),
-			"received":  newCustomMetric("upstream", "received", "receive counter", []string{"server", "upstream"}),
-			"sent":      newCustomMetric("upstream", "sent", "sent counter", []string{"server", "upstream"}),
-			"downtime":  newCustomMetric("upstream", "downtime", "downtime counter", []string{"server", "upstream"}),
-			"responses": newCustomMetric("upstream", "responses", "response counter", []string{"server", "upstream", "code"}),
+			"requests":                      newCustomMetric("upstream", "requests", "requests counter", []string{"server", "upstream"}, prometheus.CounterValue),
+			"fails":                         newCustomMetric("upstream", "fails", "fails counter", []string{"server", "upstream"}, prometheus.CounterValue),
+			"received":                      newCustomMetric("upstream", "received", "receive counter", []string{"server", "upstream"}, prometheus.CounterValue),
+			"sent":                          newCustomMetric("upstream", "sent", "sent counter", []string{"server", "upstream"}, prometheus.CounterValue),
+			"downtime":                      newCustomMetric("upstream", "downtime", "downtime counter", []string{"server", "upstream"}, prometheus.CounterValue),
+			"responses":                     newCustomMetric("upstream", "responses", "response counter", []string{"server", "upstream", "code"}, prometheus.CounterValue),
+			"peer_state":                    newCustomMetric("upstream", "peer_state", "current state of the upstream peer, one-hot encoded", []string{"server", "upstream", "state"}, prometheus.GaugeValue),
+			"peer_health_check_last_passed": newCustomMetric("upstream", "peer_health_check_last_passed", "was the last health check of the upstream peer successful", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"peer_active":                   newCustomMetric("upstream", "peer_active", "active connections to the upstream peer", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"peer_keepalive":                newCustomMetric("upstream", "peer_keepalive", "keepalive connections to the upstream peer", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"peer_max_conns":                newCustomMetric("upstream", "peer_max_conns", "configured max_conns of the upstream peer", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"peer_weight":                   newCustomMetric("upstream", "peer_weight", "configured weight of the upstream peer", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"peer_response_time_seconds":    newCustomMetric("upstream", "peer_response_time_seconds", "average response time from the upstream peer, in seconds", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"peer_header_time_seconds":      newCustomMetric("upstream", "peer_header_time_seconds", "average time to receive the response header from the upstream peer, in seconds", []string{"server", "upstream"}, prometheus.GaugeValue),
+			"queue_size":                    newCustomMetric("upstream", "queue_size", "number of requests currently in the upstream queue", []string{"server"}, prometheus.GaugeValue),
+			"queue_max_size":                newCustomMetric("upstream", "queue_max_size", "configured maximum size of the upstream queue", []string{"server"}, prometheus.GaugeValue),
+			"queue_overflows":               newCustomMetric("upstream", "queue_overflows", "requests rejected because the upstream queue was full", []string{"server"}, prometheus.CounterValue),
 		},
+		streamServerMetrics: map[string]*prometheus.Desc{
+			"connections": newCustomMetric("stream_server", "connections", "stream server zone connections", []string{"server"}, prometheus.CounterValue),
+			"received":    newCustomMetric("stream_server", "received", "stream server zone bytes received", []string{"server"}, prometheus.CounterValue),
+			"sent":        newCustomMetric("stream_server", "sent", "stream server zone bytes sent", []string{"server"}, prometheus.CounterValue),
+		},
+		streamUpstreamMetrics: map[string]*prometheus.Desc{
+			"connections": newCustomMetric("stream_upstream", "connections", "stream upstream peer connections", []string{"server", "upstream"}, prometheus.CounterValue),
+			"received":    newCustomMetric("stream_upstream", "received", "stream upstream peer bytes received", []string{"server", "upstream"}, prometheus.CounterValue),
+			"sent":        newCustomMetric("stream_upstream", "sent", "stream upstream peer bytes sent", []string{"server", "upstream"}, prometheus.CounterValue),
+			"fails":       newCustomMetric("stream_upstream", "fails", "stream upstream peer fails counter", []string{"server", "upstream"}, prometheus.CounterValue),
+			"downtime":    newCustomMetric("stream_upstream", "downtime", "stream upstream peer downtime counter", []string{"server", "upstream"}, prometheus.CounterValue),
+		},
+		locationZoneMetrics: map[string]*prometheus.Desc{
+			"requests":  newCustomMetric("location_zone", "requests", "location zone requests counter", []string{"location"}, prometheus.CounterValue),
+			"discarded": newCustomMetric("location_zone", "discarded", "location zone discarded requests counter", []string{"location"}, prometheus.CounterValue),
+			"received":  newCustomMetric("location_zone", "received", "location zone bytes received", []string{"location"}, prometheus.CounterValue),
+			"sent":      newCustomMetric("location_zone", "sent", "location zone bytes sent", []string{"location"}, prometheus.CounterValue),
+			"responses": newCustomMetric("location_zone", "responses", "location zone responses counter", []string{"location", "code"}, prometheus.CounterValue),
+		},
+		resolverMetrics: map[string]*prometheus.Desc{
+			"requests":  newCustomMetric("resolver", "requests", "resolver requests counter", []string{"resolver", "type"}, prometheus.CounterValue),
+			"responses": newCustomMetric("resolver", "responses", "resolver responses counter", []string{"resolver", "status"}, prometheus.CounterValue),
+		},
+		cacheMetrics: map[string]*prometheus.Desc{
+			"size":      newCustomMetric("cache", "size", "cache zone size in bytes", []string{"cache"}, prometheus.GaugeValue),
+			"max_size":  newCustomMetric("cache", "max_size", "cache zone max size in bytes", []string{"cache"}, prometheus.GaugeValue),
+			"cold":      newCustomMetric("cache", "cold", "cache zone is still warming up", []string{"cache"}, prometheus.GaugeValue),
+			"responses": newCustomMetric("cache", "responses", "cache responses counter", []string{"cache", "status"}, prometheus.CounterValue),
+			"bytes":     newCustomMetric("cache", "bytes", "cache bytes counter", []string{"cache", "status"}, prometheus.CounterValue),
+		},
+		slabMetrics: map[string]*prometheus.Desc{
+			"pages_used":  newCustomMetric("slab", "pages_used", "slab pages in use", []string{"zone"}, prometheus.GaugeValue),
+			"pages_free":  newCustomMetric("slab", "pages_free", "slab pages free", []string{"zone"}, prometheus.GaugeValue),
+			"slots_used":  newCustomMetric("slab", "slots_used", "slab slots in use", []string{"zone", "slot"}, prometheus.GaugeValue),
+			"slots_free":  newCustomMetric("slab", "slots_free", "slab slots free", []string{"zone", "slot"}, prometheus.GaugeValue),
+			"slots_reqs":  newCustomMetric("slab", "slots_reqs", "slab slot allocation requests counter", []string{"zone", "slot"}, prometheus.CounterValue),
+			"slots_fails": newCustomMetric("slab", "slots_fails", "slab slot allocation failures counter", []string{"zone", "slot"}, prometheus.CounterValue),
+		},
+		up:                 newCustomMetric("", "up", "Was the last scrape of nginx successful.", nil, prometheus.GaugeValue),
+		totalScrapesDesc:   totalScrapesDesc,
+		scrapeFailuresDesc: scrapeFailuresDesc,
+		stats:              scrapeStatsFor(uri),
+		metricDescs:        metricDescs,
+	}, nil
+}
+
+// newHTTPClient builds the *http.Client used to fetch nginx stats, applying
+// the TLS/mTLS settings configured via -nginx.ca-file, -nginx.client-cert
+// and -nginx.client-key, and honoring -insecure for certificate validation.
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+
+	if *nginxCAFile != "" {
+		caCert, err := ioutil.ReadFile(*nginxCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", *nginxCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if *nginxClientCert != "" || *nginxClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(*nginxClientCert, *nginxClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// readBearerToken returns the contents of -nginx.bearer-token-file, trimmed
+// of surrounding whitespace, or "" if the flag was not set.
+func readBearerToken() (string, error) {
+	if *nginxBearerTokenFile == "" {
+		return "", nil
+	}
+
+	token, err := ioutil.ReadFile(*nginxBearerTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// reservedLabelNames are the variable label names used on metrics throughout
+// this file. A const label sharing one of these names would make every
+// affected prometheus.NewDesc carry a duplicate-label error that
+// MustNewConstMetric panics on at scrape time, so parseConstLabels refuses
+// to set them.
+var reservedLabelNames = map[string]bool{
+	"server":   true,
+	"upstream": true,
+	"code":     true,
+	"location": true,
+	"resolver": true,
+	"type":     true,
+	"cache":    true,
+	"status":   true,
+	"zone":     true,
+	"slot":     true,
+	"state":    true,
+}
+
+// parseConstLabels turns a "label1=value1,label2=value2" flag value into a
+// prometheus.Labels map. Empty input yields nil so metrics are unaffected.
+func parseConstLabels(s string) prometheus.Labels {
+	if s == "" {
+		return nil
+	}
+
+	labels := make(prometheus.Labels)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Printf("ignoring malformed const label %q", pair)
+			continue
+		}
+		if reservedLabelNames[kv[0]] {
+			log.Printf("ignoring const label %q: %q is already used as a variable label", pair, kv[0])
+			continue
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels
 }
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
@@ -164,44 +534,187 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.upstreamMetrics {
 		ch <- m
 	}
+	for _, m := range e.streamServerMetrics {
+		ch <- m
+	}
+	for _, m := range e.streamUpstreamMetrics {
+		ch <- m
+	}
+	for _, m := range e.locationZoneMetrics {
+		ch <- m
+	}
+	for _, m := range e.resolverMetrics {
+		ch <- m
+	}
+	for _, m := range e.cacheMetrics {
+		ch <- m
+	}
+	for _, m := range e.slabMetrics {
+		ch <- m
+	}
+	ch <- e.up
+	ch <- e.totalScrapesDesc
+	ch <- e.scrapeFailuresDesc
 
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	// data, err := ioutil.ReadFile("./sample.json")
-	body, err := fetchHTTP(e.URI, 2*time.Second)()
-	if err != nil {
-		log.Println("fetchHTTP failed", err)
-		return
+	atomic.AddUint64(&e.stats.total, 1)
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(e.totalScrapesDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&e.stats.total)))
+		ch <- prometheus.MustNewConstMetric(e.scrapeFailuresDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&e.stats.failures)))
+	}()
+
+	var err error
+	if *nginxAPIVersion > 0 {
+		err = e.collectAPI(ch)
+	} else {
+		err = e.collectLegacy(ch)
 	}
-	defer body.Close()
 
-	data, err := ioutil.ReadAll(body)
 	if err != nil {
-		log.Println("ioutil.ReadAll failed", err)
+		atomic.AddUint64(&e.stats.failures, 1)
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
 		return
 	}
 
+	ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 1)
+}
+
+// collectLegacy scrapes the legacy stub status module exposed by e.URI.
+func (e *Exporter) collectLegacy(ch chan<- prometheus.Metric) error {
+	// data, err := ioutil.ReadFile("./sample.json")
 	var nginxStats NginxStats
-	err = json.Unmarshal(data, &nginxStats)
-	if err != nil {
-		log.Println("json.Unmarshal failed", err)
-		return
+	if err := e.fetchJSON(e.URI, 2*time.Second, &nginxStats); err != nil {
+		log.Println("fetching stub status failed", err)
+		return err
+	}
+
+	e.emitConnections(ch, nginxStats.Connections)
+	e.emitSSL(ch, nginxStats.SSLs)
+	e.emitRequests(ch, nginxStats.Requests)
+	e.emitServerZones(ch, nginxStats.ServerZones)
+	e.emitUpstreamZones(ch, nginxStats.UpstreamZones)
+
+	return nil
+}
+
+// collectAPI scrapes the modern NGINX Plus /api/{version} endpoint, pulling
+// in whichever resource groups are enabled via the -nginx.* flags.
+func (e *Exporter) collectAPI(ch chan<- prometheus.Metric) error {
+	base := fmt.Sprintf("%s/%d", *nginxAPIURI, *nginxAPIVersion)
+	timeout := 2 * time.Second
+
+	var connections ConnectionsStats
+	if err := e.fetchJSON(base+"/connections", timeout, &connections); err != nil {
+		log.Println("fetching connections from nginx plus api failed", err)
+		return err
+	}
+	e.emitConnections(ch, connections)
+
+	var ssl SSLStats
+	if err := e.fetchJSON(base+"/ssl", timeout, &ssl); err != nil {
+		log.Println("fetching ssl from nginx plus api failed", err)
+		return err
+	}
+	e.emitSSL(ch, ssl)
+
+	var requests RequestsStats
+	if err := e.fetchJSON(base+"/http/requests", timeout, &requests); err != nil {
+		log.Println("fetching http requests from nginx plus api failed", err)
+		return err
+	}
+	e.emitRequests(ch, requests)
+
+	var serverZones map[string]Server
+	if err := e.fetchJSON(base+"/http/server_zones", timeout, &serverZones); err != nil {
+		log.Println("fetching http server zones from nginx plus api failed", err)
+		return err
+	}
+	e.emitServerZones(ch, serverZones)
+
+	var upstreams map[string]Upstream
+	if err := e.fetchJSON(base+"/http/upstreams", timeout, &upstreams); err != nil {
+		log.Println("fetching http upstreams from nginx plus api failed", err)
+		return err
+	}
+	e.emitUpstreamZones(ch, upstreams)
+
+	if *enableLocationZones {
+		var locationZones map[string]LocationZone
+		if err := e.fetchJSON(base+"/http/location_zones", timeout, &locationZones); err != nil {
+			log.Println("fetching http location zones from nginx plus api failed", err)
+		} else {
+			e.emitLocationZones(ch, locationZones)
+		}
+	}
+
+	if *enableCaches {
+		var caches map[string]Cache
+		if err := e.fetchJSON(base+"/http/caches", timeout, &caches); err != nil {
+			log.Println("fetching http caches from nginx plus api failed", err)
+		} else {
+			e.emitCaches(ch, caches)
+		}
+	}
+
+	if *enableStreamZones {
+		var streamServerZones map[string]StreamServerZone
+		if err := e.fetchJSON(base+"/stream/server_zones", timeout, &streamServerZones); err != nil {
+			log.Println("fetching stream server zones from nginx plus api failed", err)
+		} else {
+			e.emitStreamServerZones(ch, streamServerZones)
+		}
+
+		var streamUpstreams map[string]StreamUpstream
+		if err := e.fetchJSON(base+"/stream/upstreams", timeout, &streamUpstreams); err != nil {
+			log.Println("fetching stream upstreams from nginx plus api failed", err)
+		} else {
+			e.emitStreamUpstreamZones(ch, streamUpstreams)
+		}
 	}
 
-	// connections
-	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["accepted"], prometheus.CounterValue, float64(nginxStats.Connections.Accepted))
-	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["dropped"], prometheus.CounterValue, float64(nginxStats.Connections.Dropped))
-	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["active"], prometheus.GaugeValue, float64(nginxStats.Connections.Active))
-	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["idle"], prometheus.GaugeValue, float64(nginxStats.Connections.Idle))
+	if *enableResolvers {
+		var resolvers map[string]Resolver
+		if err := e.fetchJSON(base+"/resolvers", timeout, &resolvers); err != nil {
+			log.Println("fetching resolvers from nginx plus api failed", err)
+		} else {
+			e.emitResolvers(ch, resolvers)
+		}
+	}
 
-	// ssl
-	ch <- prometheus.MustNewConstMetric(e.sslMetrics["handshakes"], prometheus.CounterValue, float64(nginxStats.SSLs.Handshakes))
-	ch <- prometheus.MustNewConstMetric(e.sslMetrics["handshakes_failed"], prometheus.CounterValue, float64(nginxStats.SSLs.HandshakesFailed))
-	ch <- prometheus.MustNewConstMetric(e.sslMetrics["session_reuses"], prometheus.CounterValue, float64(nginxStats.SSLs.SessionReuses))
+	if *enableSlabs {
+		var slabs map[string]Slab
+		if err := e.fetchJSON(base+"/slabs", timeout, &slabs); err != nil {
+			log.Println("fetching slabs from nginx plus api failed", err)
+		} else {
+			e.emitSlabs(ch, slabs)
+		}
+	}
 
-	// ServerZones
-	for host, s := range nginxStats.ServerZones {
+	return nil
+}
+
+func (e *Exporter) emitConnections(ch chan<- prometheus.Metric, c ConnectionsStats) {
+	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["accepted"], prometheus.CounterValue, float64(c.Accepted))
+	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["dropped"], prometheus.CounterValue, float64(c.Dropped))
+	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["active"], prometheus.GaugeValue, float64(c.Active))
+	ch <- prometheus.MustNewConstMetric(e.connectionsMetrics["idle"], prometheus.GaugeValue, float64(c.Idle))
+}
+
+func (e *Exporter) emitSSL(ch chan<- prometheus.Metric, s SSLStats) {
+	ch <- prometheus.MustNewConstMetric(e.sslMetrics["handshakes"], prometheus.CounterValue, float64(s.Handshakes))
+	ch <- prometheus.MustNewConstMetric(e.sslMetrics["handshakes_failed"], prometheus.CounterValue, float64(s.HandshakesFailed))
+	ch <- prometheus.MustNewConstMetric(e.sslMetrics["session_reuses"], prometheus.CounterValue, float64(s.SessionReuses))
+}
+
+func (e *Exporter) emitRequests(ch chan<- prometheus.Metric, r RequestsStats) {
+	ch <- prometheus.MustNewConstMetric(e.requestsMetrics["total"], prometheus.CounterValue, float64(r.Total))
+	ch <- prometheus.MustNewConstMetric(e.requestsMetrics["current"], prometheus.GaugeValue, float64(r.Current))
+}
+
+func (e *Exporter) emitServerZones(ch chan<- prometheus.Metric, zones map[string]Server) {
+	for host, s := range zones {
 		ch <- prometheus.MustNewConstMetric(e.serverMetrics["processing"], prometheus.GaugeValue, float64(s.Processing), host)
 		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.Requests), host)
 		ch <- prometheus.MustNewConstMetric(e.serverMetrics["discarded"], prometheus.CounterValue, float64(s.Discarded), host)
@@ -212,11 +725,19 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(e.serverMetrics["responses"], prometheus.CounterValue, float64(s.Responses.Responses3xx), host, "3xx")
 		ch <- prometheus.MustNewConstMetric(e.serverMetrics["responses"], prometheus.CounterValue, float64(s.Responses.Responses4xx), host, "4xx")
 		ch <- prometheus.MustNewConstMetric(e.serverMetrics["responses"], prometheus.CounterValue, float64(s.Responses.Responses5xx), host, "5xx")
-
 	}
+}
+
+// upstreamPeerStates are the states reported in Upstream.Peers[].State, used
+// to one-hot encode upstream_peer_state.
+var upstreamPeerStates = []string{"up", "down", "unavail", "checking", "unhealthy"}
+
+func (e *Exporter) emitUpstreamZones(ch chan<- prometheus.Metric, zones map[string]Upstream) {
+	for host, zone := range zones {
+		ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["queue_size"], prometheus.GaugeValue, float64(zone.Queue.Size), host)
+		ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["queue_max_size"], prometheus.GaugeValue, float64(zone.Queue.MaxSize), host)
+		ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["queue_overflows"], prometheus.CounterValue, float64(zone.Queue.Overflows), host)
 
-	// UpstreamZones
-	for host, zone := range nginxStats.UpstreamZones {
 		for _, p := range zone.Peers {
 			upstream := p.Server
 			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(p.Requests), host, upstream)
@@ -229,57 +750,311 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["responses"], prometheus.CounterValue, float64(p.Responses.Responses3xx), host, upstream, "3xx")
 			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["responses"], prometheus.CounterValue, float64(p.Responses.Responses4xx), host, upstream, "4xx")
 			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["responses"], prometheus.CounterValue, float64(p.Responses.Responses5xx), host, upstream, "5xx")
+
+			for _, state := range upstreamPeerStates {
+				ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_state"], prometheus.GaugeValue, boolToFloat(p.State == state), host, upstream, state)
+			}
+			if p.HealthChecks.LastPassed != nil {
+				ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_health_check_last_passed"], prometheus.GaugeValue, boolToFloat(*p.HealthChecks.LastPassed), host, upstream)
+			}
+			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_active"], prometheus.GaugeValue, float64(p.Active), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_keepalive"], prometheus.GaugeValue, float64(p.Keepalive), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_max_conns"], prometheus.GaugeValue, float64(p.MaxConns), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_weight"], prometheus.GaugeValue, float64(p.Weight), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_response_time_seconds"], prometheus.GaugeValue, float64(p.ResponseTime)/1000, host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peer_header_time_seconds"], prometheus.GaugeValue, float64(p.HeaderTime)/1000, host, upstream)
 		}
 	}
+}
 
+func (e *Exporter) emitStreamServerZones(ch chan<- prometheus.Metric, zones map[string]StreamServerZone) {
+	for name, z := range zones {
+		ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connections"], prometheus.CounterValue, float64(z.Connections), name)
+		ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["received"], prometheus.CounterValue, float64(z.Received), name)
+		ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["sent"], prometheus.CounterValue, float64(z.Sent), name)
+	}
 }
 
-func fetchHTTP(uri string, timeout time.Duration) func() (io.ReadCloser, error) {
-	http.DefaultClient.Timeout = timeout
+func (e *Exporter) emitStreamUpstreamZones(ch chan<- prometheus.Metric, zones map[string]StreamUpstream) {
+	for host, zone := range zones {
+		for _, p := range zone.Peers {
+			upstream := p.Server
+			ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connections"], prometheus.CounterValue, float64(p.Connections), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["received"], prometheus.CounterValue, float64(p.Received), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["sent"], prometheus.CounterValue, float64(p.Sent), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["fails"], prometheus.CounterValue, float64(p.Fails), host, upstream)
+			ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["downtime"], prometheus.CounterValue, float64(p.Downtime), host, upstream)
+		}
+	}
+}
 
-	return func() (io.ReadCloser, error) {
-		resp, err := http.DefaultClient.Get(uri)
-		if err != nil {
-			return nil, err
+func (e *Exporter) emitLocationZones(ch chan<- prometheus.Metric, zones map[string]LocationZone) {
+	for location, z := range zones {
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["requests"], prometheus.CounterValue, float64(z.Requests), location)
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["discarded"], prometheus.CounterValue, float64(z.Discarded), location)
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["received"], prometheus.CounterValue, float64(z.Received), location)
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["sent"], prometheus.CounterValue, float64(z.Sent), location)
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["responses"], prometheus.CounterValue, float64(z.Responses.Responses1xx), location, "1xx")
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["responses"], prometheus.CounterValue, float64(z.Responses.Responses2xx), location, "2xx")
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["responses"], prometheus.CounterValue, float64(z.Responses.Responses3xx), location, "3xx")
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["responses"], prometheus.CounterValue, float64(z.Responses.Responses4xx), location, "4xx")
+		ch <- prometheus.MustNewConstMetric(e.locationZoneMetrics["responses"], prometheus.CounterValue, float64(z.Responses.Responses5xx), location, "5xx")
+	}
+}
+
+func (e *Exporter) emitResolvers(ch chan<- prometheus.Metric, resolvers map[string]Resolver) {
+	for name, r := range resolvers {
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["requests"], prometheus.CounterValue, float64(r.Requests.Name), name, "name")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["requests"], prometheus.CounterValue, float64(r.Requests.Srv), name, "srv")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["requests"], prometheus.CounterValue, float64(r.Requests.Addr), name, "addr")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.NoError), name, "noerror")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Formerr), name, "formerr")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Servfail), name, "servfail")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Nxdomain), name, "nxdomain")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Notimp), name, "notimp")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Refused), name, "refused")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Timedout), name, "timedout")
+		ch <- prometheus.MustNewConstMetric(e.resolverMetrics["responses"], prometheus.CounterValue, float64(r.Responses.Unknown), name, "unknown")
+	}
+}
+
+func (e *Exporter) emitCaches(ch chan<- prometheus.Metric, caches map[string]Cache) {
+	for name, c := range caches {
+		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["size"], prometheus.GaugeValue, float64(c.Size), name)
+		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["max_size"], prometheus.GaugeValue, float64(c.MaxSize), name)
+		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["cold"], prometheus.GaugeValue, boolToFloat(c.Cold), name)
+
+		for status, stats := range map[string]CacheStats{
+			"hit":         c.Hit,
+			"stale":       c.Stale,
+			"updating":    c.Updating,
+			"revalidated": c.Revalidated,
+			"miss":        c.Miss,
+			"expired":     c.Expired,
+			"bypass":      c.Bypass,
+		} {
+			ch <- prometheus.MustNewConstMetric(e.cacheMetrics["responses"], prometheus.CounterValue, float64(stats.Responses), name, status)
+			ch <- prometheus.MustNewConstMetric(e.cacheMetrics["bytes"], prometheus.CounterValue, float64(stats.Bytes), name, status)
 		}
-		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			resp.Body.Close()
-			return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+}
+
+func (e *Exporter) emitSlabs(ch chan<- prometheus.Metric, slabs map[string]Slab) {
+	for zone, s := range slabs {
+		ch <- prometheus.MustNewConstMetric(e.slabMetrics["pages_used"], prometheus.GaugeValue, float64(s.Pages.Used), zone)
+		ch <- prometheus.MustNewConstMetric(e.slabMetrics["pages_free"], prometheus.GaugeValue, float64(s.Pages.Free), zone)
+		for slot, stats := range s.Slots {
+			ch <- prometheus.MustNewConstMetric(e.slabMetrics["slots_used"], prometheus.GaugeValue, float64(stats.Used), zone, slot)
+			ch <- prometheus.MustNewConstMetric(e.slabMetrics["slots_free"], prometheus.GaugeValue, float64(stats.Free), zone, slot)
+			ch <- prometheus.MustNewConstMetric(e.slabMetrics["slots_reqs"], prometheus.CounterValue, float64(stats.Reqs), zone, slot)
+			ch <- prometheus.MustNewConstMetric(e.slabMetrics["slots_fails"], prometheus.CounterValue, float64(stats.Fails), zone, slot)
 		}
-		return resp.Body, nil
 	}
 }
 
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// cancelOnClose wraps a response body so the request's context is cancelled
+// once the caller is done reading it, instead of at request time.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// fetchHTTP issues a GET against uri, bounded by a per-request timeout
+// rather than a client-wide one, applying basic-auth or bearer-token
+// credentials if they are configured.
+func (e *Exporter) fetchHTTP(uri string, timeout time.Duration) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if *nginxUsername != "" {
+		req.SetBasicAuth(*nginxUsername, *nginxPassword)
+	}
+	if e.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.bearerToken)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return &cancelOnClose{resp.Body, cancel}, nil
+}
+
+// fetchJSON fetches uri and decodes the JSON response body into v.
+func (e *Exporter) fetchJSON(uri string, timeout time.Duration, v interface{}) error {
+	body, err := e.fetchHTTP(uri, timeout)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
 var (
-	showVersion      = flag.Bool("version", false, "Print version information.")
-	listenAddress    = flag.String("telemetry.address", ":9913", "Address on which to expose metrics.")
-	metricsEndpoint  = flag.String("telemetry.endpoint", "/metrics", "Path under which to expose metrics.")
-	metricsNamespace = flag.String("metrics.namespace", "nginx", "Prometheus metrics namespace.")
-	nginxScrapeURI   = flag.String("nginx.scrape_uri", "http://localhost/status", "URI to nginx stub status page")
-	insecure         = flag.Bool("insecure", true, "Ignore server certificate if using https")
+	showVersion       = flag.Bool("version", false, "Print version information.")
+	dumpMetricsPath   = flag.String("dump-metrics", "", "Write a JSON description (name, help, type, labels) of every exported metric to this path and exit, for use by docs generation and CI.")
+	listenAddress     = flag.String("telemetry.address", ":9913", "Address on which to expose metrics.")
+	metricsEndpoint   = flag.String("telemetry.endpoint", "/metrics", "Path under which to expose metrics.")
+	maxTrackedTargets = flag.Int("telemetry.max-targets", 1000, "Maximum number of distinct ?target= values to keep cumulative scrape counters for. The least recently scraped target is evicted once this is exceeded, bounding memory against a scrape stream of distinct, never-reused target values. 0 disables the cap.")
+	metricsNamespace  = flag.String("metrics.namespace", "nginx", "Prometheus metrics namespace.")
+	nginxScrapeURI    = flag.String("nginx.scrape_uri", "http://localhost/status", "URI to nginx stub status page")
+	insecure          = flag.Bool("insecure", true, "Ignore server certificate if using https")
+	constLabelsFlag   = flag.String("prometheus.const-labels", envString("CONST_LABELS", ""), "A comma separated list of label=value pairs applied to every exported metric, e.g. region=ap-southeast-1,env=prod. Names already used as variable labels (server, upstream, code, location, resolver, type, cache, status, zone, slot, state) are ignored.")
+
+	nginxAPIVersion     = flag.Int("nginx.api-version", 0, "NGINX Plus API version to scrape (e.g. 8). 0 keeps scraping the legacy -nginx.scrape_uri stub status module instead.")
+	nginxAPIURI         = flag.String("nginx.api-uri", "http://localhost/api", "Base URI of the NGINX Plus API, used when -nginx.api-version is set.")
+	enableStreamZones   = flag.Bool("nginx.api.stream-zones", true, "Scrape stream server and upstream zones from the NGINX Plus API.")
+	enableLocationZones = flag.Bool("nginx.api.location-zones", true, "Scrape HTTP location zones from the NGINX Plus API.")
+	enableResolvers     = flag.Bool("nginx.api.resolvers", true, "Scrape resolver metrics from the NGINX Plus API.")
+	enableCaches        = flag.Bool("nginx.api.caches", true, "Scrape HTTP cache zone metrics from the NGINX Plus API.")
+	enableSlabs         = flag.Bool("nginx.api.slabs", true, "Scrape slab allocator metrics from the NGINX Plus API.")
+
+	nginxCAFile          = flag.String("nginx.ca-file", "", "PEM encoded CA bundle to trust when scraping an https stub status endpoint.")
+	nginxClientCert      = flag.String("nginx.client-cert", "", "PEM encoded client certificate for mTLS, used together with -nginx.client-key.")
+	nginxClientKey       = flag.String("nginx.client-key", "", "PEM encoded client private key for mTLS, used together with -nginx.client-cert.")
+	nginxUsername        = flag.String("nginx.username", "", "Username for HTTP basic auth against the stub status endpoint.")
+	nginxPassword        = flag.String("nginx.password", "", "Password for HTTP basic auth against the stub status endpoint.")
+	nginxBearerTokenFile = flag.String("nginx.bearer-token-file", "", "File containing a bearer token sent as an Authorization header on every scrape.")
 )
 
+// constLabels holds the parsed -prometheus.const-labels/CONST_LABELS value.
+// It is populated in main, after flag.Parse, so it reflects whatever was
+// actually passed on the command line rather than just the flag's default.
+var constLabels prometheus.Labels
+
+// envString returns the value of the named environment variable, or def if
+// it is unset, so flags can be configured via the environment as well as
+// the command line.
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// metricsHandler serves the default exporter's metrics, unless a "target"
+// query parameter is given, in which case it scrapes that URI on-the-fly
+// with its own registry, the same pattern used by blackbox_exporter and
+// snmp_exporter. This lets one exporter process serve an entire fleet via
+// Prometheus relabel_configs instead of one container per NGINX instance.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	exporter, err := NewExporter(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// metricDump is one entry of the -dump-metrics JSON output.
+type metricDump struct {
+	Name   string   `json:"name"`
+	Help   string   `json:"help"`
+	Type   string   `json:"type"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// dumpMetrics writes a JSON description of every metric a default Exporter
+// would expose to path, sorted by name, for use by docs generation and CI
+// metric inventory checks.
+func dumpMetrics(path string) error {
+	exporter, err := NewExporter(*nginxScrapeURI)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *prometheus.Desc, 256)
+	go func() {
+		exporter.Describe(ch)
+		close(ch)
+	}()
+
+	var dumps []metricDump
+	for d := range ch {
+		dump, ok := exporter.metricDescs[d]
+		if !ok {
+			dump = metricDump{Help: d.String()}
+		}
+		dumps = append(dumps, dump)
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].Name < dumps[j].Name })
+
+	data, err := json.MarshalIndent(dumps, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
 func init() {
 	prometheus.MustRegister(version.NewCollector("nginx_plus_exporter"))
 }
 
 func main() {
 	flag.Parse()
+	constLabels = parseConstLabels(*constLabelsFlag)
 
 	if *showVersion {
 		fmt.Fprintln(os.Stdout, version.Print("Nginx plus exporter"))
 		os.Exit(0)
 	}
 
+	if *dumpMetricsPath != "" {
+		if err := dumpMetrics(*dumpMetricsPath); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	log.Printf("Starting nginx plus exporter %s", version.Info())
 	log.Printf("Build context %s", version.BuildContext())
 
-	exporter := NewExporter(*nginxScrapeURI)
+	exporter, err := NewExporter(*nginxScrapeURI)
+	if err != nil {
+		log.Fatal(err)
+	}
 	prometheus.MustRegister(exporter)
 	prometheus.Unregister(prometheus.NewProcessCollector(os.Getpid(), ""))
 	prometheus.Unregister(prometheus.NewGoCollector())
 
-	http.Handle(*metricsEndpoint, promhttp.Handler())
+	http.HandleFunc(*metricsEndpoint, metricsHandler)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>Nginx Exporter</title></head>
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseConstLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string
+	}{
+		{name: "empty", in: "", want: nil},
+		{
+			name: "single pair",
+			in:   "region=ap-southeast-1",
+			want: map[string]string{"region": "ap-southeast-1"},
+		},
+		{
+			name: "multiple pairs",
+			in:   "region=ap-southeast-1,env=prod",
+			want: map[string]string{"region": "ap-southeast-1", "env": "prod"},
+		},
+		{
+			name: "malformed pair without equals is ignored",
+			in:   "region=ap-southeast-1,garbage",
+			want: map[string]string{"region": "ap-southeast-1"},
+		},
+		{
+			name: "empty key is ignored",
+			in:   "=value,env=prod",
+			want: map[string]string{"env": "prod"},
+		},
+		{
+			name: "empty segment is ignored",
+			in:   "env=prod,,region=ap-southeast-1",
+			want: map[string]string{"env": "prod", "region": "ap-southeast-1"},
+		},
+		{
+			name: "reserved variable label name is ignored",
+			in:   "server=prod,env=prod",
+			want: map[string]string{"env": "prod"},
+		},
+		{
+			name: "value may contain equals signs",
+			in:   "query=a=b",
+			want: map[string]string{"query": "a=b"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseConstLabels(tc.in)
+			if len(got) != len(tc.want) {
+				t.Fatalf("parseConstLabels(%q) = %v, want %v", tc.in, got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("parseConstLabels(%q)[%q] = %q, want %q", tc.in, k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	if err := dumpMetrics(path); err != nil {
+		t.Fatalf("dumpMetrics: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading dump: %v", err)
+	}
+
+	var dumps []metricDump
+	if err := json.Unmarshal(data, &dumps); err != nil {
+		t.Fatalf("unmarshaling dump: %v", err)
+	}
+
+	if len(dumps) == 0 {
+		t.Fatal("dumpMetrics wrote no metrics")
+	}
+
+	var sawRequestsTotal bool
+	for i, d := range dumps {
+		if d.Name == "" {
+			t.Errorf("dumps[%d] has empty name", i)
+		}
+		if i > 0 && dumps[i-1].Name > d.Name {
+			t.Errorf("dumps not sorted by name: %q came after %q", d.Name, dumps[i-1].Name)
+		}
+		if d.Name == "nginx_requests_total" {
+			sawRequestsTotal = true
+		}
+	}
+	if !sawRequestsTotal {
+		t.Error("dump is missing nginx_requests_total")
+	}
+}